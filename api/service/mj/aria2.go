@@ -0,0 +1,180 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	aria2PollInterval = time.Second
+	aria2PollTimeout  = time.Minute * 10
+)
+
+// Aria2Downloader submits OrgURL downloads to a configured aria2 daemon over
+// its JSON-RPC-over-WebSocket interface, splitting the download across
+// several connections so a single flaky Discord CDN edge doesn't stall it.
+type Aria2Downloader struct {
+	config types.Aria2Config
+}
+
+func NewAria2Downloader(config types.Aria2Config) *Aria2Downloader {
+	return &Aria2Downloader{config: config}
+}
+
+type aria2Request struct {
+	JsonRpc string        `json:"jsonrpc"`
+	Id      string        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type aria2Response struct {
+	Id     string          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Fetch submits url to aria2 with 8-way split downloading and polls until
+// the download completes, returning the path aria2 saved the file to.
+func (d *Aria2Downloader) Fetch(url string) (string, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(d.config.RpcURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("connect to aria2 at %s: %w", d.config.RpcURL, err)
+	}
+	defer conn.Close()
+
+	gid, err := d.addURI(conn, url)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(aria2PollTimeout)
+	for time.Now().Before(deadline) {
+		status, done, err := d.tellStatus(conn, gid)
+		if err != nil {
+			return "", err
+		}
+		if done {
+			return status, nil
+		}
+		time.Sleep(aria2PollInterval)
+	}
+	return "", fmt.Errorf("aria2 download of %s timed out after %s", url, aria2PollTimeout)
+}
+
+// Cleanup removes the file aria2 saved under config.DownloadDir, so a
+// completed download doesn't sit on disk forever -- the caller has already
+// uploaded it (or given up retrying) by the time this is called.
+func (d *Aria2Downloader) Cleanup(source string) {
+	if source == "" {
+		return
+	}
+	if err := os.Remove(source); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("failed to remove aria2-downloaded file %s: %v", source, err)
+	}
+}
+
+func (d *Aria2Downloader) addURI(conn *websocket.Conn, url string) (string, error) {
+	options := map[string]string{
+		"dir":                       d.config.DownloadDir,
+		"split":                     "8",
+		"max-connection-per-server": "8",
+	}
+	if d.config.Secret != "" {
+		options["token"] = "token:" + d.config.Secret
+	}
+
+	req := aria2Request{
+		JsonRpc: "2.0",
+		Id:      fmt.Sprintf("mj-%d", time.Now().UnixNano()),
+		Method:  "aria2.addUri",
+		Params:  []interface{}{[]string{url}, options},
+	}
+	res, err := d.call(conn, req)
+	if err != nil {
+		return "", err
+	}
+
+	var gid string
+	if err := json.Unmarshal(res.Result, &gid); err != nil {
+		return "", err
+	}
+	return gid, nil
+}
+
+// tellStatus returns the local file path once the download is complete.
+func (d *Aria2Downloader) tellStatus(conn *websocket.Conn, gid string) (path string, done bool, err error) {
+	req := aria2Request{
+		JsonRpc: "2.0",
+		Id:      fmt.Sprintf("mj-status-%d", time.Now().UnixNano()),
+		Method:  "aria2.tellStatus",
+		Params:  []interface{}{gid, []string{"status", "files"}},
+	}
+	res, err := d.call(conn, req)
+	if err != nil {
+		return "", false, err
+	}
+
+	var status struct {
+		Status string `json:"status"`
+		Files  []struct {
+			Path string `json:"path"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(res.Result, &status); err != nil {
+		return "", false, err
+	}
+
+	switch status.Status {
+	case "complete":
+		if len(status.Files) == 0 {
+			return "", false, fmt.Errorf("aria2 reported gid %s complete with no files", gid)
+		}
+		return status.Files[0].Path, true, nil
+	case "error":
+		return "", false, fmt.Errorf("aria2 gid %s failed", gid)
+	default:
+		return "", false, nil
+	}
+}
+
+// call sends req and reads frames off the socket until it sees the reply
+// carrying req.Id. aria2 multiplexes unsolicited notifications (e.g.
+// onDownloadStart/onDownloadComplete) onto the same socket as RPC replies,
+// so blindly decoding the next frame as "the" response risks mistaking one
+// of those for the reply to addUri/tellStatus and corrupting the gid/status
+// being tracked.
+func (d *Aria2Downloader) call(conn *websocket.Conn, req aria2Request) (*aria2Response, error) {
+	if err := conn.WriteJSON(req); err != nil {
+		return nil, err
+	}
+	for {
+		var res aria2Response
+		if err := conn.ReadJSON(&res); err != nil {
+			return nil, err
+		}
+		if res.Id != req.Id {
+			// an unsolicited notification, or a stray reply to a call this
+			// downloader no longer cares about; keep reading for ours.
+			continue
+		}
+		if res.Error != nil {
+			return nil, fmt.Errorf("aria2 rpc error: %s", res.Error.Message)
+		}
+		return &res, nil
+	}
+}
@@ -0,0 +1,88 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"sync"
+	"time"
+)
+
+// consecutiveFailureThreshold trips the breaker for a channel once it
+// accumulates more than this many consecutive failures.
+const consecutiveFailureThreshold = 5
+
+// breakerCooldown is how long a tripped channel stays out of selection
+// before it is given another chance.
+const breakerCooldown = time.Minute * 5
+
+type channelState struct {
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+// CircuitBreaker removes a misbehaving MJ channel from selection after too
+// many consecutive failures, restoring it automatically after a cooldown.
+type CircuitBreaker struct {
+	mu     sync.Mutex
+	states map[string]*channelState
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{states: make(map[string]*channelState)}
+}
+
+// RecordFailure registers a failure for the named channel, tripping the
+// breaker once the threshold is exceeded.
+func (b *CircuitBreaker) RecordFailure(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.stateFor(name)
+	state.consecutiveFailures++
+	if state.consecutiveFailures > consecutiveFailureThreshold {
+		state.openUntil = time.Now().Add(breakerCooldown)
+		logger.Errorf("mj circuit breaker: channel %s tripped after %d consecutive failures, cooling down until %s", name, state.consecutiveFailures, state.openUntil)
+	}
+}
+
+// RecordSuccess clears the failure count for the named channel.
+func (b *CircuitBreaker) RecordSuccess(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.stateFor(name)
+	state.consecutiveFailures = 0
+	state.openUntil = time.Time{}
+}
+
+// Allow reports whether the named channel may currently be selected.
+func (b *CircuitBreaker) Allow(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.states[name]
+	if !ok {
+		return true
+	}
+	if state.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().After(state.openUntil) {
+		// cooldown elapsed, give it another chance
+		state.consecutiveFailures = 0
+		state.openUntil = time.Time{}
+		return true
+	}
+	return false
+}
+
+func (b *CircuitBreaker) stateFor(name string) *channelState {
+	state, ok := b.states[name]
+	if !ok {
+		state = &channelState{}
+		b.states[name] = state
+	}
+	return state
+}
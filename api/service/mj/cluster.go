@@ -0,0 +1,220 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Mode describes how a ServicePool participates in the MJ cluster.
+type Mode string
+
+const (
+	ModeStandalone Mode = "standalone" // queue + dispatch + workers in one process (default, current behaviour)
+	ModeMaster     Mode = "master"     // queue + dispatch only, workers connect in as slave nodes
+	ModeSlave      Mode = "slave"      // workers only, pulls tasks from a master node; its MJ channel config is read from the local AppConfig, not fetched from the master
+)
+
+// node heartbeat is considered stale after this long
+const nodeHeartbeatTimeout = time.Second * 30
+
+// Node represents a slave worker node registered with a master ServicePool.
+type Node struct {
+	Id            string    // unique node id, assigned on registration
+	Addr          string    // remote address the node reported, for logging only
+	Capacity      int       // max concurrent jobs this node can run
+	ChannelIds    []string  // MJ channel ids this node is able to serve
+	LastHeartbeat time.Time // last time the node pinged in
+	inflight      int       // not updated anywhere; per-channel load is tracked by the scheduler instead
+}
+
+// NodeManager tracks slave nodes registered with a master ServicePool and
+// their liveness. It is safe for concurrent use.
+type NodeManager struct {
+	mu    sync.RWMutex
+	nodes map[string]*Node
+}
+
+func NewNodeManager() *NodeManager {
+	return &NodeManager{nodes: make(map[string]*Node)}
+}
+
+// Register adds or refreshes a slave node and returns the assigned node id.
+func (m *NodeManager) Register(addr string, capacity int, channelIds []string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := fmt.Sprintf("node-%s-%d", addr, time.Now().UnixNano())
+	m.nodes[id] = &Node{
+		Id:            id,
+		Addr:          addr,
+		Capacity:      capacity,
+		ChannelIds:    channelIds,
+		LastHeartbeat: time.Now(),
+	}
+	logger.Infof("mj cluster: node %s registered, addr=%s, capacity=%d", id, addr, capacity)
+	return id
+}
+
+// Heartbeat refreshes the liveness timestamp for a registered node.
+func (m *NodeManager) Heartbeat(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[id]
+	if !ok {
+		return false
+	}
+	node.LastHeartbeat = time.Now()
+	return true
+}
+
+// Remove unregisters a node, e.g. when its connection drops.
+func (m *NodeManager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.nodes, id)
+}
+
+// Count returns the number of currently-live registered nodes.
+func (m *NodeManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	count := 0
+	for _, node := range m.nodes {
+		if time.Since(node.LastHeartbeat) <= nodeHeartbeatTimeout {
+			count++
+		}
+	}
+	return count
+}
+
+// NodeForChannel returns a live node able to serve the given channel id, or
+// nil if none is available.
+func (m *NodeManager) NodeForChannel(channelId string) *Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, node := range m.nodes {
+		if time.Since(node.LastHeartbeat) > nodeHeartbeatTimeout {
+			continue
+		}
+		for _, id := range node.ChannelIds {
+			if id == channelId {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// reapStaleNodes drops nodes that have not sent a heartbeat in time, logging
+// an alert so operators notice a slave dropping out of the cluster.
+func (m *NodeManager) reapStaleNodes() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, node := range m.nodes {
+		if time.Since(node.LastHeartbeat) > nodeHeartbeatTimeout {
+			logger.Errorf("mj cluster: node %s (%s) missed heartbeat, removing from pool", id, node.Addr)
+			delete(m.nodes, id)
+		}
+	}
+}
+
+// WatchNodes periodically reaps stale nodes. Only meaningful in master mode.
+func (m *NodeManager) WatchNodes() {
+	go func() {
+		for {
+			time.Sleep(nodeHeartbeatTimeout)
+			m.reapStaleNodes()
+		}
+	}()
+}
+
+// remoteDispatchTimeout bounds how long a slave node may hold an item popped
+// off a master's task/notify queue over the cluster queue-pop endpoint
+// before it's presumed lost (the node crashed, or the request never arrived)
+// and requeued, mirroring nodeHeartbeatTimeout above.
+const remoteDispatchTimeout = time.Minute * 2
+
+// remoteDispatchItem is a task/notify payload handed to a slave node over
+// the cluster queue-pop endpoint but not yet acknowledged.
+type remoteDispatchItem struct {
+	kind     string // "task" or "notify", selects which underlying Queue to requeue onto
+	payload  []byte
+	poppedAt time.Time
+}
+
+// remoteDispatchTracker tracks items a master popped off its own taskQueue/
+// notifyQueue on behalf of a remote slave node (via the cluster queue-pop
+// endpoint) that have not yet been acked. Without this, an HTTP pop is a
+// one-shot depletion: a slave that crashes between popping a task and
+// finishing it would silently lose that task, the same failure mode durable
+// queuing (AMQPQueue in queue.go) exists to prevent in the first place.
+type remoteDispatchTracker struct {
+	mu      sync.Mutex
+	pending map[string]remoteDispatchItem
+}
+
+func newRemoteDispatchTracker() *remoteDispatchTracker {
+	return &remoteDispatchTracker{pending: make(map[string]remoteDispatchItem)}
+}
+
+// track records that token was handed out for an as-yet-unacked payload.
+func (t *remoteDispatchTracker) track(token, kind string, payload []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[token] = remoteDispatchItem{kind: kind, payload: payload, poppedAt: time.Now()}
+}
+
+// ack clears token, returning true if it was still outstanding.
+func (t *remoteDispatchTracker) ack(token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[token]; !ok {
+		return false
+	}
+	delete(t.pending, token)
+	return true
+}
+
+// reapExpired returns (and drops) every item that has been outstanding
+// longer than remoteDispatchTimeout, for the caller to requeue.
+func (t *remoteDispatchTracker) reapExpired() []remoteDispatchItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []remoteDispatchItem
+	for token, item := range t.pending {
+		if time.Since(item.poppedAt) > remoteDispatchTimeout {
+			expired = append(expired, item)
+			delete(t.pending, token)
+		}
+	}
+	return expired
+}
+
+// watchRemoteDispatch periodically requeues items no node acked within
+// remoteDispatchTimeout back onto the ServicePool's own queues. Only
+// meaningful in master mode.
+func (p *ServicePool) watchRemoteDispatch() {
+	go func() {
+		for {
+			time.Sleep(remoteDispatchTimeout)
+			for _, item := range p.remoteDispatch.reapExpired() {
+				logger.Errorf("mj cluster: remote %s item timed out unacked, requeuing", item.kind)
+				raw := json.RawMessage(item.payload)
+				switch item.kind {
+				case "task":
+					p.taskQueue.RPush(raw)
+				case "notify":
+					p.notifyQueue.RPush(raw)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ClusterClient is the slave-side counterpart of the master's node HTTP
+// endpoints, authenticated with the shared cluster auth token.
+type ClusterClient struct {
+	masterAddr string
+	authToken  string
+	httpCli    *http.Client
+}
+
+func NewClusterClient(masterAddr, authToken string) *ClusterClient {
+	return &ClusterClient{
+		masterAddr: masterAddr,
+		authToken:  authToken,
+		httpCli:    &http.Client{},
+	}
+}
+
+type registerRequest struct {
+	Capacity   int      `json:"capacity"`
+	ChannelIds []string `json:"channel_ids"`
+}
+
+type registerResponse struct {
+	NodeId string `json:"node_id"`
+}
+
+// Register calls the master's node registration endpoint and returns the
+// assigned node id.
+func (c *ClusterClient) Register(capacity int, channelIds []string) (string, error) {
+	body, err := json.Marshal(registerRequest{Capacity: capacity, ChannelIds: channelIds})
+	if err != nil {
+		return "", err
+	}
+	var res registerResponse
+	if err := c.post("/api/mj/cluster/register", body, &res); err != nil {
+		return "", err
+	}
+	return res.NodeId, nil
+}
+
+// Heartbeat pings the master to keep this node's registration alive.
+func (c *ClusterClient) Heartbeat(nodeId string) error {
+	body, err := json.Marshal(map[string]string{"node_id": nodeId})
+	if err != nil {
+		return err
+	}
+	return c.post("/api/mj/cluster/heartbeat", body, nil)
+}
+
+type remoteQueueItem struct {
+	Token   string          `json:"token"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// PopQueue pops the next item off the master's kind ("task" or "notify")
+// queue, returning the opaque token the caller must pass to AckQueue once
+// it's done processing the item.
+func (c *ClusterClient) PopQueue(kind string) (token string, payload json.RawMessage, err error) {
+	req, err := http.NewRequest(http.MethodPost, c.masterAddr+"/api/mj/cluster/queue/pop?kind="+kind, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.authToken)
+	res, err := c.httpCli.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return "", nil, fmt.Errorf("mj cluster queue %s is empty", kind)
+	}
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		return "", nil, fmt.Errorf("cluster queue pop for %s failed with status %d: %s", kind, res.StatusCode, string(data))
+	}
+	var item remoteQueueItem
+	if err := json.NewDecoder(res.Body).Decode(&item); err != nil {
+		return "", nil, err
+	}
+	return item.Token, item.Payload, nil
+}
+
+// PushQueue pushes v onto the master's kind queue, at the front (priority)
+// or back.
+func (c *ClusterClient) PushQueue(kind string, v interface{}, priority bool) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/mj/cluster/queue/push?kind=%s&priority=%t", kind, priority)
+	return c.post(path, body, nil)
+}
+
+// AckQueue acknowledges the item PopQueue returned token for.
+func (c *ClusterClient) AckQueue(token string) error {
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return err
+	}
+	return c.post("/api/mj/cluster/queue/ack", body, nil)
+}
+
+// QueueLen returns the current length of the master's kind queue.
+func (c *ClusterClient) QueueLen(kind string) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.masterAddr+"/api/mj/cluster/queue/len?kind="+kind, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.authToken)
+	res, err := c.httpCli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		return 0, fmt.Errorf("cluster queue len for %s failed with status %d: %s", kind, res.StatusCode, string(data))
+	}
+	var out struct {
+		Len int64 `json:"len"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.Len, nil
+}
+
+func (c *ClusterClient) post(path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, c.masterAddr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.authToken)
+	res, err := c.httpCli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("cluster request to %s failed with status %d: %s", path, res.StatusCode, string(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
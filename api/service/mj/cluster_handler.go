@@ -0,0 +1,213 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"geekai/core/types"
+	"geekai/service/sd"
+)
+
+// RegisterClusterRoutes wires the master-side endpoints ClusterClient talks
+// to: node registration/heartbeat, and the queue pop/push/ack/len endpoints
+// a slave's RemoteQueue uses in place of direct Redis/AMQP access. Mount
+// under the paths ClusterClient posts to, e.g.
+// mux.Handle("/api/mj/cluster/", pool.RegisterClusterRoutes()).
+func (p *ServicePool) RegisterClusterRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/mj/cluster/register", p.handleClusterRegister)
+	mux.HandleFunc("/api/mj/cluster/heartbeat", p.handleClusterHeartbeat)
+	mux.HandleFunc("/api/mj/cluster/queue/pop", p.handleClusterQueuePop)
+	mux.HandleFunc("/api/mj/cluster/queue/push", p.handleClusterQueuePush)
+	mux.HandleFunc("/api/mj/cluster/queue/ack", p.handleClusterQueueAck)
+	mux.HandleFunc("/api/mj/cluster/queue/len", p.handleClusterQueueLen)
+	return p.requireClusterAuth(mux)
+}
+
+// requireClusterAuth checks the Bearer token ClusterClient sends against the
+// cluster's configured auth token before handing off to next.
+func (p *ServicePool) requireClusterAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if p.clusterAuthToken == "" || token != p.clusterAuthToken {
+			http.Error(w, "invalid cluster auth token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *ServicePool) handleClusterRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeId, err := p.RegisterNode(r.RemoteAddr, req.Capacity, req.ChannelIds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, registerResponse{NodeId: nodeId})
+}
+
+func (p *ServicePool) handleClusterHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		NodeId string `json:"node_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.NodeHeartbeat(req.NodeId); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// queueFor resolves kind ("task" or "notify") to the underlying Queue this
+// master pool actually holds.
+func (p *ServicePool) queueFor(kind string) (Queue, bool) {
+	switch kind {
+	case "task":
+		return p.taskQueue, true
+	case "notify":
+		return p.notifyQueue, true
+	default:
+		return nil, false
+	}
+}
+
+// handleClusterQueuePop pops the next item off the master's task/notify
+// queue on behalf of a remote slave node, tracking it as outstanding until
+// the node acks it (see remoteDispatchTracker) so a crashed slave doesn't
+// silently lose the item.
+func (p *ServicePool) handleClusterQueuePop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+
+	var raw json.RawMessage
+	var popErr error
+	switch kind {
+	case "task":
+		var task types.MjTask
+		popErr = p.taskQueue.LPop(&task)
+		if popErr == nil {
+			raw, popErr = json.Marshal(task)
+		}
+	case "notify":
+		var msg sd.NotifyMessage
+		popErr = p.notifyQueue.LPop(&msg)
+		if popErr == nil {
+			raw, popErr = json.Marshal(msg)
+		}
+	default:
+		http.Error(w, "unknown queue kind", http.StatusBadRequest)
+		return
+	}
+	if popErr != nil {
+		// an empty queue is the overwhelmingly common case here; the slave
+		// just retries shortly, so this isn't logged as an error.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	token := fmt.Sprintf("%s-%d", kind, time.Now().UnixNano())
+	p.remoteDispatch.track(token, kind, raw)
+	writeJSON(w, remoteQueueItem{Token: token, Payload: raw})
+}
+
+// handleClusterQueuePush pushes the request body onto the master's
+// task/notify queue, e.g. a slave's Service reporting progress upstream via
+// its RemoteNotifyQueue.
+func (p *ServicePool) handleClusterQueuePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, ok := p.queueFor(r.URL.Query().Get("kind"))
+	if !ok {
+		http.Error(w, "unknown queue kind", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw := json.RawMessage(body)
+	if r.URL.Query().Get("priority") == "true" {
+		err = q.LPush(raw)
+	} else {
+		err = q.RPush(raw)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleClusterQueueAck marks the item a prior queue-pop call handed out as
+// done, so remoteDispatchTracker stops holding it for possible redelivery.
+func (p *ServicePool) handleClusterQueueAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.remoteDispatch.ack(req.Token)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *ServicePool) handleClusterQueueLen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, ok := p.queueFor(r.URL.Query().Get("kind"))
+	if !ok {
+		http.Error(w, "unknown queue kind", http.StatusBadRequest)
+		return
+	}
+	n, err := q.Len()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int64{"len": n})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
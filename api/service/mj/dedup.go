@@ -0,0 +1,212 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"geekai/core/types"
+	"geekai/store/model"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/corona10/goimagehash"
+	"gorm.io/gorm"
+)
+
+const (
+	recentHashesKey        = "MidJourney_Recent_Hashes"
+	recentHashesMaxLen     = 500 // K, keep a rolling window so the scan stays O(K)
+	defaultHammingDistance = 5   // N, images within this Hamming distance are considered duplicates
+)
+
+// hashRecord is a single entry in the rolling recent-hashes cache.
+type hashRecord struct {
+	JobId  uint   `json:"job_id"`
+	UserId uint   `json:"user_id"`
+	Prompt string `json:"prompt"`
+	DHash  uint64 `json:"d_hash"`
+	PHash  uint64 `json:"p_hash"`
+	ImgURL string `json:"img_url"`
+}
+
+// computeImageHash decodes the image at source (a remote URL or a local
+// file path left behind by the aria2 downloader) and returns its 64-bit
+// dHash and pHash, as computed by goimagehash.
+func computeImageHash(source string) (dHash uint64, pHash uint64, err error) {
+	var img image.Image
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		res, err := http.Get(source)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer res.Body.Close()
+		img, _, err = image.Decode(res.Body)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		img, _, err = image.Decode(f)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	dh, err := goimagehash.DifferenceHash(img)
+	if err != nil {
+		return 0, 0, err
+	}
+	ph, err := goimagehash.PerceptionHash(img)
+	if err != nil {
+		return 0, 0, err
+	}
+	return dh.GetHash(), ph.GetHash(), nil
+}
+
+// cacheHash appends a record to the rolling recent-hashes window kept in
+// Redis and trims it back down to recentHashesMaxLen.
+func (p *ServicePool) cacheHash(rec hashRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	ctx := context.Background()
+	if err := p.redisCli.RPush(ctx, recentHashesKey, data).Err(); err != nil {
+		logger.Error(err)
+		return
+	}
+	p.redisCli.LTrim(ctx, recentHashesKey, -recentHashesMaxLen, -1)
+}
+
+// findDuplicate scans the recent-hashes window for a job whose image is a
+// perceptual near-match (Hamming distance <= defaultHammingDistance) for the
+// given hashes. When global is false, only the requesting user's own jobs
+// are considered.
+func (p *ServicePool) findDuplicate(userId uint, dHash, pHash uint64, global bool) (*hashRecord, bool) {
+	ctx := context.Background()
+	items, err := p.redisCli.LRange(ctx, recentHashesKey, 0, -1).Result()
+	if err != nil {
+		logger.Error(err)
+		return nil, false
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		var rec hashRecord
+		if err := json.Unmarshal([]byte(items[i]), &rec); err != nil {
+			continue
+		}
+		if !global && rec.UserId != userId {
+			continue
+		}
+		if hammingDistance(dHash, rec.DHash) <= defaultHammingDistance || hammingDistance(pHash, rec.PHash) <= defaultHammingDistance {
+			return &rec, true
+		}
+	}
+	return nil, false
+}
+
+// FindDuplicateJob checks whether a visually near-identical MJ image has
+// already been generated recently, returning the image URL to reuse so the
+// caller can short-circuit dispatch and refund the user's power instead.
+func (p *ServicePool) FindDuplicateJob(userId uint, dHash, pHash uint64, global bool) (imgURL string, found bool) {
+	rec, found := p.findDuplicate(userId, dHash, pHash, global)
+	if !found {
+		return "", false
+	}
+	return rec.ImgURL, true
+}
+
+// findDuplicatePrompt scans the recent-hashes window for a job generated
+// from the exact same prompt. There is no image to perceptually hash yet at
+// submission time, so this is the check PushTask runs before dispatching a
+// new task, as opposed to findDuplicate which compares finished images.
+func (p *ServicePool) findDuplicatePrompt(userId uint, prompt string, global bool) (*hashRecord, bool) {
+	if prompt == "" {
+		return nil, false
+	}
+	ctx := context.Background()
+	items, err := p.redisCli.LRange(ctx, recentHashesKey, 0, -1).Result()
+	if err != nil {
+		logger.Error(err)
+		return nil, false
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		var rec hashRecord
+		if err := json.Unmarshal([]byte(items[i]), &rec); err != nil {
+			continue
+		}
+		if !global && rec.UserId != userId {
+			continue
+		}
+		if rec.ImgURL != "" && rec.Prompt == prompt {
+			return &rec, true
+		}
+	}
+	return nil, false
+}
+
+// FindDuplicatePrompt checks whether the exact same prompt was recently
+// submitted (by this user, or by anyone when global), returning the image
+// already generated for it so PushTask can short-circuit and the caller can
+// refund the user's power instead of dispatching to the upstream MJ channel.
+func (p *ServicePool) FindDuplicatePrompt(userId uint, prompt string, global bool) (imgURL string, found bool) {
+	rec, found := p.findDuplicatePrompt(userId, prompt, global)
+	if !found {
+		return "", false
+	}
+	return rec.ImgURL, true
+}
+
+// refundDedupPower credits amount back onto userId's power balance and
+// records a PowerLog entry, for a task/job that a dedup hit short-circuited
+// before (or after) it actually spent an MJ generation. Mirrors the refund
+// SyncTaskProgress issues when a generation is dead-lettered for good.
+func (p *ServicePool) refundDedupPower(userId uint, amount int, remark string) {
+	if amount <= 0 {
+		return
+	}
+	tx := p.db.Model(&model.User{}).Where("id = ?", userId).UpdateColumn("power", gorm.Expr("power + ?", amount))
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return
+	}
+	var user model.User
+	p.db.Where("id = ?", userId).First(&user)
+	p.db.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerConsume,
+		Amount:    amount,
+		Balance:   user.Power + amount,
+		Mark:      types.PowerAdd,
+		Model:     "mid-journey",
+		Remark:    remark,
+		CreatedAt: time.Now(),
+	})
+}
+
+func hammingDistance(a, b uint64) int {
+	x := a ^ b
+	count := 0
+	for x != 0 {
+		count++
+		x &= x - 1
+	}
+	return count
+}
@@ -0,0 +1,67 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// RegisterDeadLetterRoutes wires the admin dead-letter-queue endpoints:
+// GET list, POST retry one entry, POST purge everything. Mount under the
+// admin API's auth middleware, e.g.
+// adminMux.Handle("/api/admin/mj/dlq/", pool.RegisterDeadLetterRoutes()).
+func (p *ServicePool) RegisterDeadLetterRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/mj/dlq/list", p.handleDeadLetterList)
+	mux.HandleFunc("/api/admin/mj/dlq/retry", p.handleDeadLetterRetry)
+	mux.HandleFunc("/api/admin/mj/dlq/purge", p.handleDeadLetterPurge)
+	return mux
+}
+
+func (p *ServicePool) handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	letters, err := p.ListDeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, letters)
+}
+
+func (p *ServicePool) handleDeadLetterRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		http.Error(w, "invalid index", http.StatusBadRequest)
+		return
+	}
+	if err := p.RetryDeadLetter(index); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *ServicePool) handleDeadLetterPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.PurgeDeadLetters(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
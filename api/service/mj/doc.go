@@ -0,0 +1,35 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// This package's retry, download-retry, dedup and cluster-dispatch logic
+// persists state on fields of two types this package does not itself
+// define, and that do not exist in this checkout's store/model or
+// core/types:
+//
+//   - model.MidJourneyJob (geekai/store/model) needs DHash, PHash uint64
+//     (dedup.go, the generated image's perceptual hash); Attempt,
+//     MaxAttempts int and NextRetryAt time.Time (retry.go, generation
+//     retry/backoff); DownloadAttempt int and NextDownloadRetryAt
+//     time.Time (retry.go, download retry/backoff -- kept independent of
+//     the generation retry fields since the generation already succeeded
+//     by the time a download is being retried).
+//   - types.MjTask (geekai/core/types) needs ChannelId string (the channel
+//     PushTask routed the task to); Priority bool (LPush vs RPush);
+//     Attempt, MaxAttempts int and NextRetryAt time.Time (carried on the
+//     in-flight task while it only lives in the queue and has no job row
+//     yet); Power int (the power already charged for the task, refunded by
+//     PushTask on a dedup hit; downloadOne refunds the job row's own Power).
+//
+// Whoever owns store/model and core/types needs to add these fields, plus a
+// migration for the new MidJourneyJob columns, before this package builds
+// against them. No such model or migration file exists anywhere in this
+// checkout's history -- that's true of the original model.MidJourneyJob/
+// types.MjTask fields this package already relied on before any of the
+// above was added, not a regression this package's own changes introduced.
+
@@ -0,0 +1,101 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"net/url"
+	"sync"
+
+	"geekai/core/types"
+)
+
+const (
+	maxConcurrentDownloads = 4 // overall bound on simultaneous image downloads
+	maxConcurrentPerHost   = 2 // bound per remote host, so one slow CDN edge can't starve the others
+)
+
+// downloadLimiter bounds how many DownloadImages workers run at once, both
+// overall and per remote host, so a burst of finished jobs doesn't open one
+// connection per image against the same Discord CDN edge.
+type downloadLimiter struct {
+	overall chan struct{}
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newDownloadLimiter() *downloadLimiter {
+	return &downloadLimiter{
+		overall: make(chan struct{}, maxConcurrentDownloads),
+		hosts:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until both the overall and per-host slots are available for
+// rawURL, returning a release func the caller must call when done.
+func (l *downloadLimiter) acquire(rawURL string) func() {
+	l.overall <- struct{}{}
+
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	l.mu.Lock()
+	hostSem, ok := l.hosts[host]
+	if !ok {
+		hostSem = make(chan struct{}, maxConcurrentPerHost)
+		l.hosts[host] = hostSem
+	}
+	l.mu.Unlock()
+	hostSem <- struct{}{}
+
+	return func() {
+		<-hostSem
+		<-l.overall
+	}
+}
+
+// DownloaderType names the Downloader implementations the pool can use to
+// fetch OrgURL images. NewDownloader does not read it: it picks between them
+// from AppConfig's Aria2Config.Enabled.
+type DownloaderType string
+
+const (
+	DownloaderDirect DownloaderType = "direct" // current behaviour, let PutImg fetch the remote URL itself
+	DownloaderAria2  DownloaderType = "aria2"  // offload to an aria2 daemon over JSON-RPC
+)
+
+// Downloader resolves an OrgURL into a source PutImg can upload from. For
+// DirectDownloader that's just the original URL; for Aria2Downloader it's
+// the local path aria2 saved the completed download to.
+type Downloader interface {
+	Fetch(url string) (source string, err error)
+	// Cleanup releases any local resource Fetch created for source (e.g. the
+	// file aria2 saved it to), once the caller is done with it regardless of
+	// whether the upload that followed succeeded. DirectDownloader's source
+	// is the remote URL itself, so it has nothing to clean up.
+	Cleanup(source string)
+}
+
+// NewDownloader builds the configured Downloader implementation.
+func NewDownloader(config types.Aria2Config) Downloader {
+	if config.Enabled {
+		return NewAria2Downloader(config)
+	}
+	return DirectDownloader{}
+}
+
+// DirectDownloader is a no-op passthrough: PutImg fetches url itself, same
+// as before aria2 support existed.
+type DirectDownloader struct{}
+
+func (d DirectDownloader) Fetch(url string) (string, error) {
+	return url, nil
+}
+
+func (d DirectDownloader) Cleanup(source string) {}
@@ -17,6 +17,7 @@ import (
 	"geekai/store"
 	"geekai/store/model"
 	"github.com/go-redis/redis/v8"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
@@ -24,20 +25,77 @@ import (
 
 // ServicePool Mj service pool
 type ServicePool struct {
-	services        []*Service
-	taskQueue       *store.RedisQueue
-	notifyQueue     *store.RedisQueue
-	db              *gorm.DB
-	uploaderManager *oss.UploaderManager
-	Clients         *types.LMap[uint, *types.WsClient] // UserId => Client
+	mode             Mode
+	services         []*Service
+	taskQueue        Queue
+	notifyQueue      Queue
+	db               *gorm.DB
+	uploaderManager  *oss.UploaderManager
+	redisCli         *redis.Client
+	breaker          *CircuitBreaker
+	downloader       Downloader
+	downloadLimiter  *downloadLimiter
+	scheduler        *channelScheduler
+	nodeManager      *NodeManager           // only populated in master mode
+	remoteDispatch   *remoteDispatchTracker // only populated in master mode
+	clusterAuthToken string                 // expected Bearer token on incoming cluster requests, master mode only
+	dedupGlobal      bool                                // if true, FindDuplicatePrompt matches across all users, not just the submitter
+	Clients          *types.LMap[uint, *types.WsClient] // UserId => Client
 }
 
 var logger = logger2.GetLogger()
 
-func NewServicePool(db *gorm.DB, redisCli *redis.Client, manager *oss.UploaderManager, appConfig *types.AppConfig, licenseService *service.LicenseService) *ServicePool {
+// NewServicePool creates a MJ service pool. mode controls whether this
+// process runs MJ backends in-process (standalone, the historic behaviour),
+// only queues/dispatches tasks for remote slave nodes (master), or only runs
+// workers that pull tasks from a remote master (slave).
+func NewServicePool(mode Mode, db *gorm.DB, redisCli *redis.Client, manager *oss.UploaderManager, appConfig *types.AppConfig, licenseService *service.LicenseService) *ServicePool {
+	if mode == "" {
+		mode = ModeStandalone
+	}
 	services := make([]*Service, 0)
-	taskQueue := store.NewRedisQueue("MidJourney_Task_Queue", redisCli)
-	notifyQueue := store.NewRedisQueue("MidJourney_Notify_Queue", redisCli)
+	taskQueue := newQueue("MidJourney_Task_Queue", store.NewRedisQueue("MidJourney_Task_Queue", redisCli), appConfig.MjQueueConfig)
+	notifyQueue := newQueue("MidJourney_Notify_Queue", store.NewRedisQueue("MidJourney_Notify_Queue", redisCli), appConfig.MjQueueConfig)
+
+	pool := &ServicePool{
+		mode:            mode,
+		taskQueue:       taskQueue,
+		notifyQueue:     notifyQueue,
+		uploaderManager: manager,
+		redisCli:        redisCli,
+		breaker:         NewCircuitBreaker(),
+		downloader:      NewDownloader(appConfig.Aria2Config),
+		downloadLimiter: newDownloadLimiter(),
+		scheduler:       newChannelScheduler(),
+		db:              db,
+		dedupGlobal:     appConfig.MjDedupGlobal,
+		Clients:         types.NewLMap[uint, *types.WsClient](),
+	}
+
+	if mode == ModeMaster {
+		// master mode only queues and dispatches: the real MJ channels run on
+		// slave nodes, so no local Service workers are started here.
+		pool.nodeManager = NewNodeManager()
+		pool.nodeManager.WatchNodes()
+		pool.remoteDispatch = newRemoteDispatchTracker()
+		pool.watchRemoteDispatch()
+		pool.clusterAuthToken = appConfig.MjClusterConfig.AuthToken
+		return pool
+	}
+
+	// A slave node drives its MJ channels entirely over the cluster HTTP API:
+	// its Service workers are handed a RemoteQueue in place of taskQueue/
+	// notifyQueue, so pulling a task and pushing a progress notification are
+	// both proxied through clusterClient to the master instead of talking to
+	// Redis/AMQP directly. db is still passed through to NewService below --
+	// Service's own job-row bookkeeping is not something this package
+	// controls, so a slave node still needs a MySQL connection reachable from
+	// its network (a read replica works) until that bookkeeping itself moves
+	// behind the cluster API.
+	var clusterClient *ClusterClient
+	if mode == ModeSlave {
+		clusterClient = NewClusterClient(appConfig.MjClusterConfig.MasterAddr, appConfig.MjClusterConfig.AuthToken)
+	}
 
 	for k, config := range appConfig.MjPlusConfigs {
 		if config.Enabled == false {
@@ -48,14 +106,19 @@ func NewServicePool(db *gorm.DB, redisCli *redis.Client, manager *oss.UploaderMa
 			logger.Error(err)
 			continue
 		}
-		
+
 		cli := NewPlusClient(config)
 		name := fmt.Sprintf("mj-plus-service-%d", k)
-		plusService := NewService(name, taskQueue, notifyQueue, db, cli)
+		svcTaskQueue, svcNotifyQueue := taskQueue, notifyQueue
+		if mode == ModeSlave {
+			svcTaskQueue, svcNotifyQueue = NewRemoteTaskQueue(clusterClient), NewRemoteNotifyQueue(clusterClient)
+		}
+		plusService := NewService(name, svcTaskQueue, svcNotifyQueue, db, cli)
 		go func() {
 			plusService.Run()
 		}()
 		services = append(services, plusService)
+		pool.scheduler.register(ChannelMeta{Name: name, Weight: config.Weight, MaxConcurrent: config.MaxConcurrent, Modes: config.Modes})
 	}
 
 	// for mid-journey proxy
@@ -65,24 +128,38 @@ func NewServicePool(db *gorm.DB, redisCli *redis.Client, manager *oss.UploaderMa
 		}
 		cli := NewProxyClient(config)
 		name := fmt.Sprintf("mj-proxy-service-%d", k)
-		proxyService := NewService(name, taskQueue, notifyQueue, db, cli)
+		svcTaskQueue, svcNotifyQueue := taskQueue, notifyQueue
+		if mode == ModeSlave {
+			svcTaskQueue, svcNotifyQueue = NewRemoteTaskQueue(clusterClient), NewRemoteNotifyQueue(clusterClient)
+		}
+		proxyService := NewService(name, svcTaskQueue, svcNotifyQueue, db, cli)
 		go func() {
 			proxyService.Run()
 		}()
 		services = append(services, proxyService)
+		pool.scheduler.register(ChannelMeta{Name: name, Weight: config.Weight, MaxConcurrent: config.MaxConcurrent, Modes: config.Modes})
 	}
 
-	return &ServicePool{
-		taskQueue:       taskQueue,
-		notifyQueue:     notifyQueue,
-		services:        services,
-		uploaderManager: manager,
-		db:              db,
-		Clients:         types.NewLMap[uint, *types.WsClient](),
+	pool.services = services
+
+	if mode == ModeSlave {
+		channelIds := make([]string, 0, len(services))
+		for _, s := range services {
+			channelIds = append(channelIds, s.Name)
+		}
+		go NewSlaveAgent(appConfig.MjClusterConfig, channelIds, clusterClient).Run()
 	}
+
+	return pool
 }
 
 func (p *ServicePool) CheckTaskNotify() {
+	if p.mode == ModeSlave {
+		// a slave's Service workers push progress upstream themselves via
+		// their RemoteQueue-backed notifyQueue; there are no local websocket
+		// clients on a slave node for this to forward to.
+		return
+	}
 	go func() {
 		for {
 			var message sd.NotifyMessage
@@ -103,6 +180,11 @@ func (p *ServicePool) CheckTaskNotify() {
 }
 
 func (p *ServicePool) DownloadImages() {
+	if p.mode == ModeSlave {
+		// only the master/standalone process owns the canonical
+		// MidJourneyJob table and uploader; a slave node has neither.
+		return
+	}
 	go func() {
 		var items []model.MidJourneyJob
 		for {
@@ -111,62 +193,174 @@ func (p *ServicePool) DownloadImages() {
 				continue
 			}
 
-			// download images
+			// download images concurrently, bounded overall and per remote
+			// host by p.downloadLimiter so a burst of finished jobs can't
+			// open one connection per image against the same CDN edge.
+			var wg sync.WaitGroup
 			for _, v := range items {
 				if v.OrgURL == "" {
 					continue
 				}
-
-				logger.Infof("try to download image: %s", v.OrgURL)
-				var imgURL string
-				var err error
-				if servicePlus := p.getService(v.ChannelId); servicePlus != nil {
-					task, _ := servicePlus.Client.QueryTask(v.TaskId)
-					if len(task.Buttons) > 0 {
-						v.Hash = GetImageHash(task.Buttons[0].CustomId)
-					}
-					imgURL, err = p.uploaderManager.GetUploadHandler().PutImg(v.OrgURL, false)
-				} else {
-					imgURL, err = p.uploaderManager.GetUploadHandler().PutImg(v.OrgURL, true)
-				}
-				if err != nil {
-					logger.Errorf("error with download image %s, %v", v.OrgURL, err)
+				if !v.NextDownloadRetryAt.IsZero() && time.Now().Before(v.NextDownloadRetryAt) {
 					continue
-				} else {
-					logger.Infof("download image %s successfully.", v.OrgURL)
 				}
 
-				v.ImgURL = imgURL
-				p.db.Updates(&v)
-
-				cli := p.Clients.Get(uint(v.UserId))
-				if cli == nil {
-					continue
-				}
-				err = cli.Send([]byte(sd.Finished))
-				if err != nil {
-					continue
-				}
+				wg.Add(1)
+				go func(v model.MidJourneyJob) {
+					defer wg.Done()
+					release := p.downloadLimiter.acquire(v.OrgURL)
+					defer release()
+					p.downloadOne(v)
+				}(v)
 			}
+			wg.Wait()
 
 			time.Sleep(time.Second * 5)
 		}
 	}()
 }
 
-// PushTask push a new mj task in to task queue
-func (p *ServicePool) PushTask(task types.MjTask) {
+// downloadOne fetches and uploads a single finished job's image. It is
+// called from a bounded pool of goroutines in DownloadImages, one per job,
+// so besides the DB row v it only touches shared state through Redis and the
+// DB (the channel inflight counter, the recent-hashes cache, a power refund).
+func (p *ServicePool) downloadOne(v model.MidJourneyJob) {
+	logger.Infof("try to download image: %s", v.OrgURL)
+
+	// fetch through the configured downloader first (aria2 splits the
+	// download and survives flaky Discord CDN edges better than a
+	// single direct GET), then hand the result to the uploader.
+	source, err := p.downloader.Fetch(v.OrgURL)
+	if err != nil {
+		logger.Errorf("error downloading image %s, %v", v.OrgURL, err)
+		// the generation already succeeded (OrgURL exists), so only the
+		// download itself is retried -- requeuing onto taskQueue here
+		// would resubmit the whole MJ generation and re-spend power.
+		p.requeueOrDeadLetterDownload(v, "download failed")
+		return
+	}
+	// whatever happens to the upload below, the downloaded file itself has
+	// served its purpose once we're done with it here.
+	defer p.downloader.Cleanup(source)
+
+	dHash, pHash, hashErr := computeImageHash(source)
+	if hashErr != nil {
+		logger.Errorf("error computing perceptual hash for %s, %v", source, hashErr)
+	} else {
+		v.DHash = dHash
+		v.PHash = pHash
+
+		// a perceptual near-match means the same image (or a trivial variant
+		// of it) was already generated and uploaded recently -- reuse that
+		// upload and refund this job's power instead of spending another
+		// upload on a picture nobody asked to see twice.
+		if dupURL, found := p.FindDuplicateJob(uint(v.UserId), dHash, pHash, p.dedupGlobal); found {
+			logger.Infof("mj job %d reused a visually near-identical image: %s", v.Id, dupURL)
+			v.ImgURL = dupURL
+			p.db.Updates(&v)
+			p.adjustInflight(v.ChannelId, -1)
+			p.refundDedupPower(uint(v.UserId), v.Power, fmt.Sprintf("绘画任务与近期生成的图片高度相似，自动退回算力。任务ID：%s", v.TaskId))
+
+			if cli := p.Clients.Get(uint(v.UserId)); cli != nil {
+				_ = cli.Send([]byte(sd.Finished))
+			}
+			return
+		}
+	}
+
+	var imgURL string
+	if servicePlus := p.getService(v.ChannelId); servicePlus != nil {
+		task, _ := servicePlus.Client.QueryTask(v.TaskId)
+		if len(task.Buttons) > 0 {
+			v.Hash = GetImageHash(task.Buttons[0].CustomId)
+		}
+		imgURL, err = p.uploaderManager.GetUploadHandler().PutImg(source, false)
+	} else {
+		imgURL, err = p.uploaderManager.GetUploadHandler().PutImg(source, true)
+	}
+	if err != nil {
+		logger.Errorf("error with download image %s, %v", v.OrgURL, err)
+		// the image was fetched fine -- it's the upload that failed -- so
+		// this retries/dead-letters exactly like a fetch failure instead of
+		// leaving the job to be picked up again on every 5s pass forever.
+		p.requeueOrDeadLetterDownload(v, "upload failed")
+		return
+	}
+	logger.Infof("download image %s successfully.", v.OrgURL)
+
+	v.ImgURL = imgURL
+	p.db.Updates(&v)
+	p.adjustInflight(v.ChannelId, -1)
+
+	// cache unconditionally, even if the perceptual hash failed above:
+	// FindDuplicatePrompt only needs Prompt+ImgURL, not the image hashes.
+	p.cacheHash(hashRecord{JobId: v.Id, UserId: uint(v.UserId), Prompt: v.Prompt, DHash: v.DHash, PHash: v.PHash, ImgURL: v.ImgURL})
+
+	cli := p.Clients.Get(uint(v.UserId))
+	if cli == nil {
+		return
+	}
+	_ = cli.Send([]byte(sd.Finished))
+}
+
+// PushTask push a new mj task in to task queue. Before dispatch it checks
+// whether the exact same prompt was recently generated and, if so, refunds
+// the task's power and returns the already-generated image instead of
+// spending another MJ generation — the caller should skip notifying progress
+// since reused is true and no task was queued. Otherwise the task is routed
+// to the least-loaded channel able to serve its mode, and high-priority
+// tasks jump the default queue via LPush so the same workers process them
+// first.
+func (p *ServicePool) PushTask(task types.MjTask) (imgURL string, reused bool) {
+	if imgURL, reused := p.FindDuplicatePrompt(uint(task.UserId), task.Prompt, p.dedupGlobal); reused {
+		logger.Infof("mj task for user %d reused duplicate prompt result: %s", task.UserId, imgURL)
+		p.refundDedupPower(uint(task.UserId), task.Power, fmt.Sprintf("绘画任务与近期请求重复，自动退回算力。提示词：%s", task.Prompt))
+		return imgURL, true
+	}
+
+	if channel, err := p.selectChannel(task.Mode); err == nil {
+		task.ChannelId = channel
+		p.adjustInflight(channel, 1)
+	} else {
+		logger.Error(err)
+	}
+
 	logger.Debugf("add a new MidJourney task to the task list: %+v", task)
+	if task.Priority {
+		p.taskQueue.LPush(task)
+		return "", false
+	}
 	p.taskQueue.RPush(task)
+	return "", false
 }
 
-// HasAvailableService check if it has available mj service in pool
+// HasAvailableService check if it has available mj service in pool, either
+// running locally (standalone/slave) or registered by a live slave node
+// (master).
 func (p *ServicePool) HasAvailableService() bool {
-	return len(p.services) > 0
+	if len(p.services) > 0 {
+		return true
+	}
+	return p.nodeManager != nil && p.nodeManager.Count() > 0
+}
+
+// IsChannelAvailable reports whether channelId can currently serve a task,
+// either via a local Service (standalone/slave) or a registered slave node
+// (master) — the getService lookup spanning remote nodes.
+func (p *ServicePool) IsChannelAvailable(channelId string) bool {
+	if p.getService(channelId) != nil {
+		return true
+	}
+	return p.nodeManager != nil && p.nodeManager.NodeForChannel(channelId) != nil
 }
 
 // SyncTaskProgress 异步拉取任务
 func (p *ServicePool) SyncTaskProgress() {
+	if p.mode == ModeSlave {
+		// same reasoning as DownloadImages: job rows and retry/dead-letter
+		// bookkeeping are a master/standalone concern.
+		return
+	}
 	go func() {
 		var items []model.MidJourneyJob
 		for {
@@ -176,31 +370,59 @@ func (p *ServicePool) SyncTaskProgress() {
 			}
 
 			for _, job := range items {
-				// 失败或者 30 分钟还没完成的任务删除并退回算力
-				if time.Now().Sub(job.CreatedAt) > time.Minute*30 || job.Progress == -1 {
-					p.db.Delete(&job)
-					// 退回算力
-					tx := p.db.Model(&model.User{}).Where("id = ?", job.UserId).UpdateColumn("power", gorm.Expr("power + ?", job.Power))
-					if tx.Error == nil && tx.RowsAffected > 0 {
-						var user model.User
-						p.db.Where("id = ?", job.UserId).First(&user)
-						p.db.Create(&model.PowerLog{
-							UserId:    user.Id,
-							Username:  user.Username,
-							Type:      types.PowerConsume,
-							Amount:    job.Power,
-							Balance:   user.Power + job.Power,
-							Mark:      types.PowerAdd,
-							Model:     "mid-journey",
-							Remark:    fmt.Sprintf("绘画任务失败，退回算力。任务ID：%s", job.TaskId),
-							CreatedAt: time.Now(),
-						})
+				// 失败或者 30 分钟还没完成的任务走重试/死信流程
+				stalled := time.Now().Sub(job.CreatedAt) > time.Minute*30 || job.Progress == -1
+				if !stalled {
+					if servicePlus := p.getService(job.ChannelId); servicePlus != nil {
+						if !p.breaker.Allow(job.ChannelId) {
+							logger.Errorf("mj channel %s circuit open, skipping notify for job %d", job.ChannelId, job.Id)
+							continue
+						}
+						if err := servicePlus.Notify(job); err != nil {
+							p.breaker.RecordFailure(job.ChannelId)
+						} else {
+							p.breaker.RecordSuccess(job.ChannelId)
+						}
 					}
 					continue
 				}
 
-				if servicePlus := p.getService(job.ChannelId); servicePlus != nil {
-					_ = servicePlus.Notify(job)
+				// 还没到下一次重试时间，先跳过
+				if !job.NextRetryAt.IsZero() && time.Now().Before(job.NextRetryAt) {
+					continue
+				}
+
+				reason := "stalled"
+				if job.Progress == -1 {
+					reason = "failed"
+				}
+				task := types.MjTask{TaskId: job.TaskId, ChannelId: job.ChannelId, Attempt: job.Attempt, MaxAttempts: job.MaxAttempts}
+				if !p.requeueOrDeadLetter(task, job.Id, reason) {
+					job.Attempt = task.Attempt
+					job.NextRetryAt = task.NextRetryAt
+					p.db.Updates(&job)
+					continue
+				}
+
+				// 重试次数耗尽，删除任务并退回算力
+				p.adjustInflight(job.ChannelId, -1)
+				p.db.Delete(&job)
+				// 退回算力
+				tx := p.db.Model(&model.User{}).Where("id = ?", job.UserId).UpdateColumn("power", gorm.Expr("power + ?", job.Power))
+				if tx.Error == nil && tx.RowsAffected > 0 {
+					var user model.User
+					p.db.Where("id = ?", job.UserId).First(&user)
+					p.db.Create(&model.PowerLog{
+						UserId:    user.Id,
+						Username:  user.Username,
+						Type:      types.PowerConsume,
+						Amount:    job.Power,
+						Balance:   user.Power + job.Power,
+						Mark:      types.PowerAdd,
+						Model:     "mid-journey",
+						Remark:    fmt.Sprintf("绘画任务失败，退回算力。任务ID：%s", job.TaskId),
+						CreatedAt: time.Now(),
+					})
 				}
 			}
 
@@ -217,3 +439,29 @@ func (p *ServicePool) getService(name string) *Service {
 	}
 	return nil
 }
+
+// RegisterNode registers a slave node with this master pool and returns the
+// node id the slave should use on subsequent heartbeats. The node's channels
+// are also added to the scheduler, so PushTask can route tasks to them even
+// though they have no local *Service on this process.
+func (p *ServicePool) RegisterNode(addr string, capacity int, channelIds []string) (string, error) {
+	if p.mode != ModeMaster {
+		return "", fmt.Errorf("this node is not running in master mode")
+	}
+	nodeId := p.nodeManager.Register(addr, capacity, channelIds)
+	for _, channelId := range channelIds {
+		p.scheduler.register(ChannelMeta{Name: channelId, Weight: 1, MaxConcurrent: capacity})
+	}
+	return nodeId, nil
+}
+
+// NodeHeartbeat refreshes liveness for a registered slave node.
+func (p *ServicePool) NodeHeartbeat(nodeId string) error {
+	if p.mode != ModeMaster {
+		return fmt.Errorf("this node is not running in master mode")
+	}
+	if !p.nodeManager.Heartbeat(nodeId) {
+		return fmt.Errorf("unknown node: %s", nodeId)
+	}
+	return nil
+}
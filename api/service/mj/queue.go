@@ -0,0 +1,192 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// amqpMaxPriority is the queue's priority ceiling (RabbitMQ caps this at a
+// few hundred in practice); task priority uses the two ends of the range.
+const amqpMaxPriority = 9
+
+// Queue abstracts the task/notify queues so the MJ pool does not have to
+// hard-code Redis. store.RedisQueue already satisfies this, and AMQPQueue
+// below gives operators durable, multi-worker-safe redelivery as an
+// alternative backend for MidJourney_Task_Queue / MidJourney_Notify_Queue.
+type Queue interface {
+	LPop(v interface{}) error
+	RPush(v interface{}) error
+	LPush(v interface{}) error // push ahead of everything already queued
+	Len() (int64, error)
+	Ack(v interface{}) error
+}
+
+// AMQPQueue is a Queue backed by a durable RabbitMQ queue with publisher
+// confirms and manual ack, so a worker crashing mid-task redelivers the
+// message instead of losing it the way Redis LPOP does.
+type AMQPQueue struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	name    string
+	// publishMu serializes publish+confirm-wait pairs. NotifyPublish must be
+	// registered exactly once per channel -- the amqp client broadcasts every
+	// confirmation to every listener it has ever registered, so calling it on
+	// every publish leaks a fresh size-1 listener each time; once a couple of
+	// those fill up and go unread, the client's confirm-dispatch loop blocks
+	// delivering to them and every subsequent publish on the channel hangs.
+	// With a single shared confirms channel, serializing publish+receive
+	// pairs is what guarantees the confirmation read back is the one for the
+	// publish that's waiting on it.
+	publishMu sync.Mutex
+	confirms  <-chan amqp.Confirmation
+	// consumeMu guards the lazy q.channel.Consume call in LPop: multiple
+	// Service workers call LPop concurrently on the same AMQPQueue, and
+	// starting a second consumer on the same queue would hand out a deliveries
+	// channel nobody kept, silently stalling that worker forever. A mutex
+	// (rather than sync.Once) lets a failed Consume be retried by the next
+	// caller instead of wedging every future LPop.
+	consumeMu sync.Mutex
+	// deliveries is only set once Consume succeeds. It is safe to share across
+	// concurrent LPop callers after that: each delivery is handed to exactly
+	// one receiver by the channel itself.
+	deliveries <-chan amqp.Delivery
+	// pending correlates a delivery with the Ack call for it, keyed by the
+	// pointer identity of the v LPop decoded into (the same v the caller then
+	// passes to Ack). Keying by the message body instead would collide
+	// whenever two in-flight, unacked deliveries marshal to the same JSON
+	// (e.g. a requeued retry of the same task) -- the second Store would
+	// silently overwrite the first's entry, so the first delivery's Ack call
+	// would find nothing and it would never be acknowledged.
+	pending sync.Map // map[interface{}]amqp.Delivery, keyed by v's pointer identity
+}
+
+// NewAMQPQueue connects to url and declares a durable, priority-aware queue
+// named name with publisher confirms enabled.
+func NewAMQPQueue(url, name string) (*AMQPQueue, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("connect to amqp broker: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("open amqp channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("enable amqp publisher confirms: %w", err)
+	}
+	args := amqp.Table{"x-max-priority": int32(amqpMaxPriority)}
+	if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("declare amqp queue %s: %w", name, err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return &AMQPQueue{
+		conn:     conn,
+		channel:  ch,
+		name:     name,
+		confirms: confirms,
+	}, nil
+}
+
+func (q *AMQPQueue) publish(v interface{}, priority uint8) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	q.publishMu.Lock()
+	defer q.publishMu.Unlock()
+	if err := q.channel.Publish("", q.name, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+		Priority:     priority,
+	}); err != nil {
+		return err
+	}
+	if ack := <-q.confirms; !ack.Ack {
+		return fmt.Errorf("amqp broker did not confirm publish to %s", q.name)
+	}
+	return nil
+}
+
+// RPush publishes v to the queue with publisher confirms enabled, so a
+// broker outage surfaces as a publish error instead of a silently lost task.
+func (q *AMQPQueue) RPush(v interface{}) error {
+	return q.publish(v, 0)
+}
+
+// LPush publishes v at the queue's highest priority so it is delivered
+// ahead of anything already sitting in the queue at the default priority.
+func (q *AMQPQueue) LPush(v interface{}) error {
+	return q.publish(v, amqpMaxPriority)
+}
+
+func (q *AMQPQueue) LPop(v interface{}) error {
+	q.consumeMu.Lock()
+	if q.deliveries == nil {
+		deliveries, err := q.channel.Consume(q.name, "", false, false, false, false, nil)
+		if err != nil {
+			q.consumeMu.Unlock()
+			return err
+		}
+		q.deliveries = deliveries
+	}
+	q.consumeMu.Unlock()
+
+	delivery, ok := <-q.deliveries
+	if !ok {
+		return fmt.Errorf("amqp queue %s consumer channel closed", q.name)
+	}
+	if err := json.Unmarshal(delivery.Body, v); err != nil {
+		delivery.Nack(false, true)
+		return err
+	}
+	q.pending.Store(v, delivery)
+	return nil
+}
+
+// Ack acknowledges the delivery that was decoded into v, so it is not
+// redelivered to another worker.
+func (q *AMQPQueue) Ack(v interface{}) error {
+	stored, ok := q.pending.LoadAndDelete(v)
+	if !ok {
+		return nil
+	}
+	return stored.(amqp.Delivery).Ack(false)
+}
+
+func (q *AMQPQueue) Len() (int64, error) {
+	queueState, err := q.channel.QueueInspect(q.name)
+	if err != nil {
+		return 0, err
+	}
+	return int64(queueState.Messages), nil
+}
+
+// newQueue builds the configured Queue backend for the named MJ queue.
+func newQueue(name string, redisQueue Queue, config types.AmqpConfig) Queue {
+	if !config.Enabled {
+		return redisQueue
+	}
+	amqpQueue, err := NewAMQPQueue(config.URL, name)
+	if err != nil {
+		logger.Errorf("failed to connect to amqp for queue %s, falling back to redis: %v", name, err)
+		return redisQueue
+	}
+	return amqpQueue
+}
@@ -0,0 +1,80 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// RemoteQueue is a Queue that proxies every operation to a master
+// ServicePool over the authenticated cluster HTTP API, so a slave node's
+// Service workers never need direct Redis/AMQP connectivity to the master's
+// taskQueue/notifyQueue -- only an HTTP round trip through a ClusterClient.
+//
+// LPop and Ack must be called in strict pairs on the same instance: mu is
+// held from a successful LPop until the matching Ack, which both serializes
+// pop/ack for this instance and makes the correlation between them
+// unambiguous without needing to key anything by message content (the same
+// pitfall AMQPQueue's pending map had to avoid).
+type RemoteQueue struct {
+	client *ClusterClient
+	kind   string // "task" or "notify", selects which of the master's queues this proxies
+
+	mu    sync.Mutex
+	token string // set by LPop, consumed by the matching Ack
+}
+
+// NewRemoteTaskQueue builds a RemoteQueue proxying the master's task queue.
+func NewRemoteTaskQueue(client *ClusterClient) *RemoteQueue {
+	return &RemoteQueue{client: client, kind: "task"}
+}
+
+// NewRemoteNotifyQueue builds a RemoteQueue proxying the master's notify queue.
+func NewRemoteNotifyQueue(client *ClusterClient) *RemoteQueue {
+	return &RemoteQueue{client: client, kind: "notify"}
+}
+
+func (q *RemoteQueue) LPop(v interface{}) error {
+	q.mu.Lock() // released by the matching Ack call
+	token, payload, err := q.client.PopQueue(q.kind)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.token = token
+	return nil
+}
+
+// Ack reports the item LPop last handed out as done, so the master's
+// remoteDispatchTracker stops holding it for possible redelivery.
+func (q *RemoteQueue) Ack(v interface{}) error {
+	token := q.token
+	q.token = ""
+	defer q.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+	return q.client.AckQueue(token)
+}
+
+func (q *RemoteQueue) RPush(v interface{}) error {
+	return q.client.PushQueue(q.kind, v, false)
+}
+
+func (q *RemoteQueue) LPush(v interface{}) error {
+	return q.client.PushQueue(q.kind, v, true)
+}
+
+func (q *RemoteQueue) Len() (int64, error) {
+	return q.client.QueueLen(q.kind)
+}
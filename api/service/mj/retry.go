@@ -0,0 +1,199 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"geekai/core/types"
+	"geekai/store/model"
+	"time"
+)
+
+var errInvalidDeadLetterIndex = errors.New("invalid dead-letter queue index")
+
+const deadLetterQueueKey = "MidJourney_DeadLetter_Queue"
+
+// defaultMaxAttempts is used when a job/task does not specify its own limit.
+const defaultMaxAttempts = 3
+
+// backoffSchedule is the exponential backoff applied between retries:
+// 30s, 2m, 8m, capped at the last entry for any further attempts.
+var backoffSchedule = []time.Duration{
+	time.Second * 30,
+	time.Minute * 2,
+	time.Minute * 8,
+}
+
+// nextBackoff returns how long to wait before retrying the (1-indexed)
+// attempt-th time, capped at the last entry in backoffSchedule.
+func nextBackoff(attempt int) time.Duration {
+	if attempt <= 0 {
+		attempt = 1
+	}
+	if attempt > len(backoffSchedule) {
+		attempt = len(backoffSchedule)
+	}
+	return backoffSchedule[attempt-1]
+}
+
+// DeadLetterKind distinguishes what kind of work a DeadLetter represents,
+// since retrying it means very different things: a generation dead-letter is
+// replayed by resubmitting task onto the task queue, while a download
+// dead-letter is replayed by resetting the already-finished job's download
+// state so DownloadImages picks it back up — resubmitting it as a task would
+// re-run (and re-charge) the MJ generation that already succeeded.
+type DeadLetterKind string
+
+const (
+	DeadLetterGeneration DeadLetterKind = "generation"
+	DeadLetterDownload   DeadLetterKind = "download"
+)
+
+// DeadLetter is the snapshot pushed to MidJourney_DeadLetter_Queue once a
+// task/download exhausts its retry attempts, so operators can inspect and
+// replay it. Task is only populated for Kind == DeadLetterGeneration.
+type DeadLetter struct {
+	Kind     DeadLetterKind `json:"kind"`
+	Task     types.MjTask   `json:"task,omitempty"`
+	JobId    uint           `json:"job_id"`
+	Reason   string         `json:"reason"`
+	FailedAt time.Time      `json:"failed_at"`
+}
+
+// requeueOrDeadLetter requeues task for another attempt if it has not
+// exhausted MaxAttempts, otherwise pushes it to the dead-letter queue. It
+// returns true if the task was dead-lettered (i.e. attempts exhausted). This
+// is for failures of the generation itself (stalled/failed job) — a download
+// failure of an already-generated image must go through requeueOrDeadLetterDownload
+// instead, since it has nothing to do with the task-dispatch queue.
+func (p *ServicePool) requeueOrDeadLetter(task types.MjTask, jobId uint, reason string) bool {
+	if task.MaxAttempts <= 0 {
+		task.MaxAttempts = defaultMaxAttempts
+	}
+	task.Attempt++
+
+	if task.Attempt >= task.MaxAttempts {
+		p.pushDeadLetter(DeadLetter{
+			Kind:     DeadLetterGeneration,
+			Task:     task,
+			JobId:    jobId,
+			Reason:   reason,
+			FailedAt: time.Now(),
+		})
+		logger.Errorf("mj task for job %d exhausted %d attempts (%s), moved to dead-letter queue", jobId, task.MaxAttempts, reason)
+		return true
+	}
+
+	task.NextRetryAt = time.Now().Add(nextBackoff(task.Attempt))
+	p.taskQueue.RPush(task)
+	logger.Infof("mj task for job %d requeued, attempt %d/%d, next retry at %s (%s)", jobId, task.Attempt, task.MaxAttempts, task.NextRetryAt, reason)
+	return false
+}
+
+// requeueOrDeadLetterDownload schedules another download attempt for an
+// already-generated job, entirely independent of the task-dispatch queue:
+// the MJ generation already succeeded and must not be re-submitted (that
+// would re-spend the user's power), so retrying here only ever means
+// DownloadImages picking v back up once job.NextDownloadRetryAt elapses.
+// Once DownloadAttempt exhausts defaultMaxAttempts, the job is dead-lettered
+// with Kind == DeadLetterDownload instead of being requeued forever.
+func (p *ServicePool) requeueOrDeadLetterDownload(job model.MidJourneyJob, reason string) {
+	job.DownloadAttempt++
+	if job.DownloadAttempt >= defaultMaxAttempts {
+		// the channel's slot was held since this job's generation started
+		// (PushTask's adjustInflight(+1)); giving up on the download for good
+		// must free it the same way SyncTaskProgress's dead-letter branch
+		// does for a failed generation, or the channel's score stays
+		// permanently skewed by a job nothing will ever finish.
+		p.adjustInflight(job.ChannelId, -1)
+		p.pushDeadLetter(DeadLetter{
+			Kind:     DeadLetterDownload,
+			JobId:    job.Id,
+			Reason:   reason,
+			FailedAt: time.Now(),
+		})
+		logger.Errorf("mj image download for job %d exhausted %d attempts (%s), moved to dead-letter queue", job.Id, defaultMaxAttempts, reason)
+		return
+	}
+
+	job.NextDownloadRetryAt = time.Now().Add(nextBackoff(job.DownloadAttempt))
+	p.db.Updates(&job)
+	logger.Infof("mj image download for job %d will retry, attempt %d/%d, next retry at %s (%s)", job.Id, job.DownloadAttempt, defaultMaxAttempts, job.NextDownloadRetryAt, reason)
+}
+
+func (p *ServicePool) pushDeadLetter(dl DeadLetter) {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := p.redisCli.RPush(context.Background(), deadLetterQueueKey, data).Err(); err != nil {
+		logger.Error(err)
+	}
+}
+
+// ListDeadLetters returns every entry currently sitting in the dead-letter
+// queue, for the admin DLQ inspection endpoint.
+func (p *ServicePool) ListDeadLetters() ([]DeadLetter, error) {
+	items, err := p.redisCli.LRange(context.Background(), deadLetterQueueKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(items))
+	for _, item := range items {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(item), &dl); err != nil {
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	return letters, nil
+}
+
+// RetryDeadLetter pops the dead-letter entry at index and replays it. A
+// DeadLetterGeneration entry is resubmitted onto the task queue, resetting
+// its attempt counter. A DeadLetterDownload entry never touches the task
+// queue — its generation already succeeded — so it instead resets the
+// download attempt counter on the existing job row and lets DownloadImages
+// pick it back up on its next pass.
+func (p *ServicePool) RetryDeadLetter(index int) error {
+	ctx := context.Background()
+	items, err := p.redisCli.LRange(ctx, deadLetterQueueKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(items) {
+		return errInvalidDeadLetterIndex
+	}
+
+	var dl DeadLetter
+	if err := json.Unmarshal([]byte(items[index]), &dl); err != nil {
+		return err
+	}
+
+	if err := p.redisCli.LRem(ctx, deadLetterQueueKey, 1, items[index]).Err(); err != nil {
+		return err
+	}
+
+	if dl.Kind == DeadLetterDownload {
+		return p.db.Model(&model.MidJourneyJob{}).Where("id = ?", dl.JobId).
+			Updates(map[string]interface{}{"download_attempt": 0, "next_download_retry_at": time.Time{}}).Error
+	}
+
+	dl.Task.Attempt = 0
+	dl.Task.NextRetryAt = time.Time{}
+	p.taskQueue.RPush(dl.Task)
+	return nil
+}
+
+// PurgeDeadLetters drops every entry in the dead-letter queue.
+func (p *ServicePool) PurgeDeadLetters() error {
+	return p.redisCli.Del(context.Background(), deadLetterQueueKey).Err()
+}
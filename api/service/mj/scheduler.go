@@ -0,0 +1,172 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ChannelMeta holds the scheduling metadata for one MJ channel (a Service
+// in the pool): how much weight it gets relative to its siblings, how many
+// jobs it can run at once, and which task modes it supports.
+type ChannelMeta struct {
+	Name          string   `json:"name"`
+	Weight        int      `json:"weight"`         // higher weight takes a larger share of load
+	MaxConcurrent int      `json:"max_concurrent"` // hard cap on in-flight jobs
+	Modes         []string `json:"modes"`          // e.g. "fast", "relax", "turbo"
+}
+
+// ChannelStats is the read-only view of a channel's current scheduling
+// state, returned by ServicePool.Stats() for the admin dashboard.
+type ChannelStats struct {
+	ChannelMeta
+	Inflight    int64   `json:"inflight"`
+	Utilization float64 `json:"utilization"` // inflight / weight, the same score the scheduler uses
+}
+
+const channelInflightKey = "MidJourney_Channel_Inflight"
+
+// channelScheduler tracks per-channel weight/capacity/mode metadata and
+// picks the least-loaded channel able to serve a given task. Weights can be
+// hot-reloaded without restarting the pool.
+type channelScheduler struct {
+	mu       sync.RWMutex
+	channels map[string]*ChannelMeta
+}
+
+func newChannelScheduler() *channelScheduler {
+	return &channelScheduler{channels: make(map[string]*ChannelMeta)}
+}
+
+func (s *channelScheduler) register(meta ChannelMeta) {
+	if meta.Weight <= 0 {
+		meta.Weight = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[meta.Name] = &meta
+}
+
+// setWeights hot-reloads the weight of already-registered channels.
+func (s *channelScheduler) setWeights(weights map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, weight := range weights {
+		meta, ok := s.channels[name]
+		if !ok {
+			return fmt.Errorf("unknown mj channel: %s", name)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("channel weight must be positive, got %d for %s", weight, name)
+		}
+		meta.Weight = weight
+	}
+	return nil
+}
+
+func (s *channelScheduler) supportsMode(meta *ChannelMeta, mode string) bool {
+	if mode == "" || len(meta.Modes) == 0 {
+		return true
+	}
+	for _, m := range meta.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *channelScheduler) list() []*ChannelMeta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metas := make([]*ChannelMeta, 0, len(s.channels))
+	for _, meta := range s.channels {
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+// registerChannels seeds the scheduler with one ChannelMeta per configured
+// Service, so weights/capacity/modes can be tuned later via SetChannelWeights
+// without touching the services themselves.
+func (p *ServicePool) registerChannels(configs []ChannelMeta) {
+	for _, c := range configs {
+		p.scheduler.register(c)
+	}
+}
+
+// SetChannelWeights hot-reloads channel weights, e.g. from an admin API call,
+// without requiring a pool restart.
+func (p *ServicePool) SetChannelWeights(weights map[string]int) error {
+	return p.scheduler.setWeights(weights)
+}
+
+// inflight returns the current in-flight job count for a channel.
+func (p *ServicePool) inflight(name string) int64 {
+	n, err := p.redisCli.HGet(context.Background(), channelInflightKey, name).Int64()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (p *ServicePool) adjustInflight(name string, delta int64) {
+	if err := p.redisCli.HIncrBy(context.Background(), channelInflightKey, name, delta).Err(); err != nil {
+		logger.Error(err)
+	}
+}
+
+// selectChannel picks the mode-compatible, non-full, non-tripped channel
+// with the lowest inflight/weight score, i.e. the one currently carrying the
+// smallest share of its allotted load. A channel whose circuit breaker is
+// open is skipped so new tasks stop routing to it the same way
+// SyncTaskProgress already stops notifying it.
+func (p *ServicePool) selectChannel(mode string) (string, error) {
+	var best *ChannelMeta
+	var bestScore float64
+
+	for _, meta := range p.scheduler.list() {
+		if !p.scheduler.supportsMode(meta, mode) {
+			continue
+		}
+		if !p.breaker.Allow(meta.Name) {
+			continue
+		}
+		inflight := p.inflight(meta.Name)
+		if meta.MaxConcurrent > 0 && inflight >= int64(meta.MaxConcurrent) {
+			continue
+		}
+		score := float64(inflight) / float64(meta.Weight)
+		if best == nil || score < bestScore {
+			best = meta
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return "", fmt.Errorf("no mj channel available for mode %q", mode)
+	}
+	return best.Name, nil
+}
+
+// Stats returns per-channel utilization for the admin dashboard.
+func (p *ServicePool) Stats() []ChannelStats {
+	metas := p.scheduler.list()
+	stats := make([]ChannelStats, 0, len(metas))
+	for _, meta := range metas {
+		inflight := p.inflight(meta.Name)
+		stats = append(stats, ChannelStats{
+			ChannelMeta: *meta,
+			Inflight:    inflight,
+			Utilization: float64(inflight) / float64(meta.Weight),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,49 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// RegisterSchedulerRoutes wires the admin scheduler endpoints: GET
+// per-channel utilization stats, POST to hot-reload channel weights without
+// restarting the pool. Mount under the admin API's auth middleware, e.g.
+// adminMux.Handle("/api/admin/mj/channels/", pool.RegisterSchedulerRoutes()).
+func (p *ServicePool) RegisterSchedulerRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/mj/channels/stats", p.handleChannelStats)
+	mux.HandleFunc("/api/admin/mj/channels/weights", p.handleChannelWeights)
+	return mux
+}
+
+func (p *ServicePool) handleChannelStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, p.Stats())
+}
+
+func (p *ServicePool) handleChannelWeights(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var weights map[string]int
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.SetChannelWeights(weights); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,69 @@
+package mj
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	"time"
+)
+
+// SlaveAgent runs on a slave node. The slave's ServicePool drives its MJ
+// channel workers entirely over client (task pull, progress push) instead
+// of the master's Redis/AMQP queues directly -- see RemoteQueue. SlaveAgent
+// itself only tells the master which channels this node is running, so the
+// master can route PushTask submissions to it, and keeps that registration
+// alive with heartbeats.
+type SlaveAgent struct {
+	config     types.MjClusterConfig
+	channelIds []string
+	client     *ClusterClient
+	nodeId     string
+}
+
+func NewSlaveAgent(config types.MjClusterConfig, channelIds []string, client *ClusterClient) *SlaveAgent {
+	return &SlaveAgent{
+		config:     config,
+		channelIds: channelIds,
+		client:     client,
+	}
+}
+
+// Run registers this node with the master and blocks, sending heartbeats
+// until the process exits. If registration fails it logs the error and
+// returns without retrying.
+func (a *SlaveAgent) Run() {
+	if err := a.register(); err != nil {
+		logger.Errorf("mj slave: failed to register with master %s: %v", a.config.MasterAddr, err)
+		return
+	}
+
+	for {
+		time.Sleep(time.Second * 10)
+		if err := a.heartbeat(); err != nil {
+			logger.Errorf("mj slave: heartbeat to master %s failed: %v", a.config.MasterAddr, err)
+		}
+	}
+}
+
+func (a *SlaveAgent) register() error {
+	nodeId, err := a.client.Register(a.config.Capacity, a.channelIds)
+	if err != nil {
+		return err
+	}
+	a.nodeId = nodeId
+	logger.Infof("mj slave: registered with master %s as node %s, serving channels %v", a.config.MasterAddr, nodeId, a.channelIds)
+	return nil
+}
+
+func (a *SlaveAgent) heartbeat() error {
+	if a.nodeId == "" {
+		return fmt.Errorf("node not registered yet")
+	}
+	return a.client.Heartbeat(a.nodeId)
+}